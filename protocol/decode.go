@@ -1,23 +1,122 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"reflect"
 )
 
+// ErrTruncatedArray is returned (via decoder.err) when an array's advertised
+// length claims more elements than are left in the input. Surfacing a typed
+// error lets callers distinguish a malicious/corrupt length prefix from a
+// clean io.EOF, rather than silently handing back a short slice.
+var ErrTruncatedArray = errors.New("truncated array: not enough input remains to decode the advertised number of elements")
+
 type discarder interface {
 	Discard(int) (int, error)
 }
 
-type decoder struct {
+// decReader is the source that a decoder pulls bytes from. It is patterned
+// after the decReader abstraction in ugorji/codec: implementations backed by
+// an io.Reader have to allocate and copy into a caller-provided buffer, while
+// implementations backed by an in-memory []byte can instead return a
+// sub-slice of the buffer with no copy at all.
+type decReader interface {
+	io.Reader
+
+	// discard skips up to n bytes of input, returning how many were
+	// actually skipped.
+	discard(n int) (int, error)
+
+	// readx returns the next n bytes of input, or as many as are left if
+	// fewer than n remain, in which case it also returns io.ErrUnexpectedEOF
+	// (ioDecReader returns io.EOF instead when no bytes at all were left).
+	// Implementations backed by a []byte return a sub-slice referencing the
+	// underlying array; callers that need the bytes to outlive the decode
+	// must copy them.
+	readx(n int) ([]byte, error)
+}
+
+// ioDecReader adapts an io.Reader to decReader. Every readx call allocates
+// and copies since an io.Reader never exposes a buffer we can slice into.
+type ioDecReader struct {
 	reader io.Reader
+}
+
+func (r *ioDecReader) Read(b []byte) (int, error) {
+	return r.reader.Read(b)
+}
+
+func (r *ioDecReader) discard(n int) (int, error) {
+	if d, ok := r.reader.(discarder); ok {
+		return d.Discard(n)
+	}
+	c, err := io.CopyN(ioutil.Discard, r.reader, int64(n))
+	return int(c), err
+}
+
+func (r *ioDecReader) readx(n int) ([]byte, error) {
+	b := make([]byte, n)
+	n, err := io.ReadFull(r.reader, b)
+	return b[:n], err
+}
+
+// bytesDecReader is a decReader over an in-memory buffer. readx returns
+// sub-slices of buf directly, so decoding never allocates on the read path.
+type bytesDecReader struct {
+	buf []byte
+	off int
+}
+
+func (r *bytesDecReader) Read(b []byte) (int, error) {
+	n := copy(b, r.buf[r.off:])
+	r.off += n
+	if n == 0 && len(b) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (r *bytesDecReader) discard(n int) (int, error) {
+	avail := len(r.buf) - r.off
+	if n > avail {
+		n = avail
+		r.off += n
+		return n, io.ErrUnexpectedEOF
+	}
+	r.off += n
+	return n, nil
+}
+
+func (r *bytesDecReader) readx(n int) ([]byte, error) {
+	avail := len(r.buf) - r.off
+	if n > avail {
+		b := r.buf[r.off:]
+		r.off = len(r.buf)
+		return b, io.ErrUnexpectedEOF
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b, nil
+}
+
+type decoder struct {
+	r      decReader
 	remain int
 	buffer [8]byte
 	err    error
 }
 
+func newDecoder(r io.Reader, remain int) *decoder {
+	return &decoder{r: &ioDecReader{reader: r}, remain: remain}
+}
+
+func newBytesDecoder(b []byte) *decoder {
+	return &decoder{r: &bytesDecReader{buf: b}, remain: len(b)}
+}
+
 func (d *decoder) Read(b []byte) (int, error) {
 	if d.err != nil {
 		return 0, d.err
@@ -28,7 +127,7 @@ func (d *decoder) Read(b []byte) (int, error) {
 	if len(b) > d.remain {
 		b = b[:d.remain]
 	}
-	n, err := d.reader.Read(b)
+	n, err := d.r.Read(b)
 	d.remain -= n
 	return n, err
 }
@@ -54,25 +153,121 @@ func (d *decoder) decodeInt64(v value) {
 }
 
 func (d *decoder) decodeString(v value) {
-	v.setString(d.readString())
+	v.setString(d.readString(false))
 }
 
 func (d *decoder) decodeBytes(v value) {
-	v.setBytes(d.readBytes())
+	v.setBytes(d.readBytes(false))
 }
 
 func (d *decoder) decodeArray(v value, elemType reflect.Type, decodeElem decodeFunc) {
 	if n := d.readInt32(); n < 0 {
 		v.setArray(array{})
 	} else {
-		a := makeArray(elemType, int(n))
-		for i := 0; i < int(n) && d.remain > 0; i++ {
-			decodeElem(d, a.index(i))
+		v.setArray(d.decodeArrayWith(int(n), elemType, decodeElem))
+	}
+}
+
+// decodeCompactArray decodes a KIP-482 compact array, whose length is
+// encoded as uvarint(n+1) with 0 meaning null.
+func (d *decoder) decodeCompactArray(v value, elemType reflect.Type, decodeElem decodeFunc) {
+	if n := d.readUvarint(); n < 1 {
+		v.setArray(array{})
+	} else {
+		v.setArray(d.decodeArrayWith(int(n-1), elemType, decodeElem))
+	}
+}
+
+// decodeArrayWith decodes n elements of elemType, growing the backing slice
+// geometrically with reflect.Append as elements are read instead of
+// pre-allocating all n up front: a crafted length prefix (e.g. n = 2^31-1)
+// would otherwise allocate gigabytes of memory before d.remain is ever
+// consulted. The initial capacity is capped to the number of elements that
+// could plausibly still fit in the remaining input, using a cheap per-element
+// lower bound. If the input runs out before n elements have been read, the
+// loop stops and sets ErrTruncatedArray rather than returning a short slice
+// silently.
+func (d *decoder) decodeArrayWith(n int, elemType reflect.Type, decodeElem decodeFunc) array {
+	if n <= 0 {
+		return makeArray(elemType, 0)
+	}
+
+	capacity := n
+	if min := minSizeOf(elemType); min > 0 {
+		if max := d.remain / min; max < capacity {
+			capacity = max
+		}
+	}
+
+	slice := reflect.MakeSlice(reflect.SliceOf(elemType), 0, capacity)
+	for i := 0; i < n; i++ {
+		if d.remain <= 0 {
+			d.setError(ErrTruncatedArray)
+			break
+		}
+		slice = reflect.Append(slice, reflect.Zero(elemType))
+		decodeElem(d, makeValue(slice.Index(slice.Len()-1)))
+	}
+	return array{value: slice}
+}
+
+// minSizeOf returns a cheap, conservative lower bound on the number of bytes
+// a single encoded value of typ occupies on the wire, used only to size the
+// initial capacity passed to reflect.MakeSlice in decodeArrayWith.
+func minSizeOf(typ reflect.Type) int {
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int8:
+		return 1
+	case reflect.Int16:
+		return 2
+	case reflect.Int32:
+		return 4
+	case reflect.Int64:
+		return 8
+	default: // strings, bytes, nested arrays, structs: at least a length/tag byte
+		return 1
+	}
+}
+
+func (d *decoder) decodeCompactString(v value) {
+	v.setString(d.readCompactString(false))
+}
+
+func (d *decoder) decodeCompactBytes(v value) {
+	v.setBytes(d.readCompactBytes(false))
+}
+
+func (d *decoder) decodeUUID(v value) {
+	b := d.read(16)
+	p := v.iface(reflect.PtrTo(uuidType)).(*[16]byte)
+	if len(b) == 16 {
+		copy(p[:], b)
+	}
+}
+
+// decodeTaggedFields reads the KIP-482 tagged-fields trailer of a flexible
+// struct: a uvarint count, followed by that many (uvarint tag id, uvarint
+// size) pairs. Tags with a registered decoder are dispatched to the matching
+// field; unknown tags are skipped over with discard so newer brokers can add
+// fields without breaking older clients.
+func (d *decoder) decodeTaggedFields(v value, tagged map[int]taggedDecodeFunc) {
+	n := int(d.readUvarint())
+	for i := 0; i < n && d.remain > 0; i++ {
+		id := int(d.readUvarint())
+		size := int(d.readUvarint())
+		if f, ok := tagged[id]; ok {
+			f.decode(d, v.fieldByIndex(f.index))
+		} else {
+			d.discard(size)
 		}
-		v.setArray(a)
 	}
 }
 
+type taggedDecodeFunc struct {
+	decode decodeFunc
+	index  index
+}
+
 func (d *decoder) discardAll() {
 	d.discard(d.remain)
 }
@@ -81,20 +276,29 @@ func (d *decoder) discard(n int) {
 	if n > d.remain {
 		n = d.remain
 	}
-	var err error
-	if r, _ := d.reader.(discarder); r != nil {
-		n, err = r.Discard(n)
-		d.remain -= n
-	} else {
-		_, err = io.Copy(ioutil.Discard, d)
-	}
+	n, err := d.r.discard(n)
+	d.remain -= n
 	d.setError(err)
 }
 
+// read returns the next n bytes of input. When the decoder is backed by a
+// bytesDecReader, the returned slice is a zero-copy sub-slice of the
+// original buffer and must not be retained past the decode unless the
+// caller has copied it (see readString/readBytes/readCompactBytes).
 func (d *decoder) read(n int) []byte {
-	b := make([]byte, n)
-	n, err := io.ReadFull(d, b)
-	b = b[:n]
+	if n > d.remain {
+		// The field claims more bytes than are left in the bounded region
+		// (e.g. a malicious/corrupt length prefix). Read only what remains
+		// so readx still returns a valid (short) slice, but report the
+		// truncation instead of silently handing back fewer bytes than the
+		// field advertised.
+		b, _ := d.r.readx(d.remain)
+		d.remain -= len(b)
+		d.setError(io.ErrUnexpectedEOF)
+		return b
+	}
+	b, err := d.r.readx(n)
+	d.remain -= len(b)
 	d.setError(err)
 	return b
 }
@@ -165,27 +369,32 @@ func (d *decoder) readInt64() int64 {
 	return 0
 }
 
-func (d *decoder) readString() string {
+// readString reads a classic (int16-length-prefixed) string. When borrow is
+// true the returned string aliases the decoder's input buffer and must only
+// be used for the duration of the current decode; callers that retain the
+// value (e.g. into a struct field) must pass borrow=false so the bytes are
+// copied.
+func (d *decoder) readString(borrow bool) string {
 	if n := d.readInt16(); n < 0 {
 		return ""
 	} else {
-		return bytesToString(d.read(int(n)))
+		return decodeToString(d.read(int(n)), borrow)
 	}
 }
 
-func (d *decoder) readCompactString() string {
+func (d *decoder) readCompactString(borrow bool) string {
 	if n := d.readVarInt(); n < 0 {
 		return ""
 	} else {
-		return bytesToString(d.read(int(n)))
+		return decodeToString(d.read(int(n)), borrow)
 	}
 }
 
-func (d *decoder) readBytes() []byte {
+func (d *decoder) readBytes(borrow bool) []byte {
 	if n := d.readInt32(); n < 0 {
 		return nil
 	} else {
-		return d.read(int(n))
+		return decodeToBytes(d.read(int(n)), borrow)
 	}
 }
 
@@ -198,12 +407,34 @@ func (d *decoder) readBytesTo(w io.Writer) bool {
 	}
 }
 
-func (d *decoder) readCompactBytes() []byte {
+func (d *decoder) readCompactBytes(borrow bool) []byte {
 	if n := d.readVarInt(); n < 0 {
 		return nil
 	} else {
-		return d.read(int(n))
+		return decodeToBytes(d.read(int(n)), borrow)
+	}
+}
+
+// decodeToString turns the bytes just read into a string. borrow=true avoids
+// a copy via bytesToString but ties the string's lifetime to the decoder's
+// buffer; borrow=false makes an independent copy.
+func decodeToString(b []byte, borrow bool) string {
+	if borrow {
+		return bytesToString(b)
 	}
+	return string(b)
+}
+
+// decodeToBytes mirrors decodeToString for []byte fields: borrow=true hands
+// back the zero-copy sub-slice, borrow=false copies it so the caller owns
+// independent memory.
+func decodeToBytes(b []byte, borrow bool) []byte {
+	if borrow {
+		return b
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
 }
 
 func (d *decoder) readCompactBytesTo(w io.Writer) bool {
@@ -242,13 +473,51 @@ func (d *decoder) readVarInt() int64 {
 	return 0
 }
 
+// readUvarint reads a plain base-128 unsigned varint, with no zigzag step.
+// This is distinct from readVarInt, which decodes the zigzag-encoded signed
+// VarInt/VarLong types: KIP-482 compact-array length prefixes and
+// tagged-field headers (count, tag id, size) are all UNSIGNED_VARINT on the
+// wire, and decoding them with the signed varint would desync every
+// flexible-version request/response against a real broker. Compact strings
+// and bytes are not read with it: readCompactString and readCompactBytes
+// take their length from readVarInt.
+func (d *decoder) readUvarint() uint64 {
+	n := 10 // unsigned varints are at most 10 bytes
+
+	if n > d.remain {
+		n = d.remain
+	}
+
+	x := uint64(0)
+	s := uint(0)
+
+	for n > 0 {
+		b := d.readByte()
+
+		if (b & 0x80) == 0 {
+			return x | uint64(b)<<s
+		}
+
+		x |= uint64(b&0x7f) << s
+		s += 7
+		n--
+	}
+
+	d.setError(fmt.Errorf("cannot decode uvarint from input stream"))
+	return 0
+}
+
 type decodeFunc func(*decoder, value)
 
 var (
 	readerFrom = reflect.TypeOf((*io.ReaderFrom)(nil)).Elem()
+	uuidType   = reflect.TypeOf([16]byte{})
 )
 
 func decodeFuncOf(typ reflect.Type, version int16, tag structTag) decodeFunc {
+	if reflect.PtrTo(typ).Implements(unmarshaler) {
+		return unmarshalerDecodeFuncOf(typ, version, tag)
+	}
 	if reflect.PtrTo(typ).Implements(readerFrom) {
 		return readerDecodeFuncOf(typ)
 	}
@@ -266,22 +535,33 @@ func decodeFuncOf(typ reflect.Type, version int16, tag structTag) decodeFunc {
 	case reflect.String:
 		return stringDecodeFuncOf(tag)
 	case reflect.Struct:
-		return structDecodeFuncOf(typ, version)
+		return DefaultSchema.DecodeFuncOf(typ, version)
 	case reflect.Slice:
 		if typ.Elem().Kind() == reflect.Uint8 { // []byte
 			return bytesDecodeFuncOf(tag)
 		}
 		return arrayDecodeFuncOf(typ, version, tag)
+	case reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 && typ.Len() == 16 { // e.g. topic/directory UUIDs
+			return (*decoder).decodeUUID
+		}
+		panic("unsupported array type: " + typ.String())
 	default:
 		panic("unsupported type: " + typ.String())
 	}
 }
 
 func stringDecodeFuncOf(tag structTag) decodeFunc {
+	if tag.Compact {
+		return (*decoder).decodeCompactString
+	}
 	return (*decoder).decodeString
 }
 
 func bytesDecodeFuncOf(tag structTag) decodeFunc {
+	if tag.Compact {
+		return (*decoder).decodeCompactBytes
+	}
 	return (*decoder).decodeBytes
 }
 
@@ -292,13 +572,24 @@ func structDecodeFuncOf(typ reflect.Type, version int16) decodeFunc {
 	}
 
 	var fields []field
+	var tagged map[int]taggedDecodeFunc
+	var flexible bool
+
 	forEachStructField(typ, func(typ reflect.Type, index index, tag string) {
 		forEachStructTag(tag, func(tag structTag) bool {
 			if tag.MinVersion <= version && version <= tag.MaxVersion {
-				fields = append(fields, field{
-					decode: decodeFuncOf(typ, version, tag),
-					index:  index,
-				})
+				if tag.Compact {
+					flexible = true
+				}
+				decode := decodeFuncOf(typ, version, tag)
+				if tag.TagID >= 0 {
+					if tagged == nil {
+						tagged = make(map[int]taggedDecodeFunc)
+					}
+					tagged[tag.TagID] = taggedDecodeFunc{decode: decode, index: index}
+				} else {
+					fields = append(fields, field{decode: decode, index: index})
+				}
 				return false
 			}
 			return true
@@ -310,12 +601,18 @@ func structDecodeFuncOf(typ reflect.Type, version int16) decodeFunc {
 			f := &fields[i]
 			f.decode(d, v.fieldByIndex(f.index))
 		}
+		if flexible {
+			d.decodeTaggedFields(v, tagged)
+		}
 	}
 }
 
 func arrayDecodeFuncOf(typ reflect.Type, version int16, tag structTag) decodeFunc {
 	elemType := typ.Elem()
 	elemFunc := decodeFuncOf(elemType, version, tag)
+	if tag.Compact {
+		return func(d *decoder, v value) { d.decodeCompactArray(v, elemType, elemFunc) }
+	}
 	return func(d *decoder, v value) { d.decodeArray(v, elemType, elemFunc) }
 }
 
@@ -323,7 +620,7 @@ func readerDecodeFuncOf(typ reflect.Type) decodeFunc {
 	typ = reflect.PtrTo(typ)
 	return func(d *decoder, v value) {
 		if d.err == nil {
-			_, d.err = v.iface(typ).(io.ReaderFrom).ReadFrom(d.reader)
+			_, d.err = v.iface(typ).(io.ReaderFrom).ReadFrom(d)
 		}
 	}
 }
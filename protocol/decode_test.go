@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBytesDecReaderReadxZeroCopy(t *testing.T) {
+	buf := []byte("hello world")
+	r := &bytesDecReader{buf: buf}
+
+	b, err := r.readx(5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("got %q", b)
+	}
+
+	// Mutating the returned slice must mutate the original buffer: readx
+	// hands back a sub-slice, not a copy.
+	b[0] = 'H'
+	if buf[0] != 'H' {
+		t.Fatalf("readx copied instead of aliasing the source buffer")
+	}
+}
+
+func TestBytesDecReaderReadxShort(t *testing.T) {
+	r := &bytesDecReader{buf: []byte("abc")}
+
+	b, err := r.readx(10)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if string(b) != "abc" {
+		t.Fatalf("expected the available bytes to be returned, got %q", b)
+	}
+}
+
+func TestDecoderReadTruncation(t *testing.T) {
+	// The decoder is bounded to 5 bytes even though the underlying source
+	// has 100; a field that claims to be 20 bytes must be reported as
+	// truncated rather than silently handed back as a short 5-byte read.
+	d := newBytesDecoder(bytes.Repeat([]byte("x"), 100))
+	d.remain = 5
+
+	b := d.read(20)
+	if len(b) != 5 {
+		t.Fatalf("expected the 5 available bytes, got %d", len(b))
+	}
+	if d.err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", d.err)
+	}
+}
+
+func TestDecoderReadExact(t *testing.T) {
+	d := newBytesDecoder([]byte("hello"))
+	b := d.read(5)
+	if string(b) != "hello" {
+		t.Fatalf("got %q", b)
+	}
+	if d.err != nil {
+		t.Fatalf("unexpected error: %v", d.err)
+	}
+	if d.remain != 0 {
+		t.Fatalf("expected remain=0, got %d", d.remain)
+	}
+}
+
+func TestDecoderDiscardBounded(t *testing.T) {
+	d := newBytesDecoder(bytes.Repeat([]byte("x"), 100))
+	d.remain = 5
+
+	d.discard(10)
+	if d.remain != 0 {
+		t.Fatalf("expected remain=0 after discarding past the bound, got %d", d.remain)
+	}
+}
+
+func TestBytesDecReaderDiscardShort(t *testing.T) {
+	r := &bytesDecReader{buf: []byte("abc")}
+
+	n, err := r.discard(10)
+	if n != 3 {
+		t.Fatalf("expected 3 bytes discarded, got %d", n)
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// TestDecoderDiscardShortBuffer exercises the scenario decodeTaggedFields'
+// unknown-tag skip relies on: when the decoder's bound (d.remain) claims more
+// bytes than the underlying buffer holds, a discard that runs past the end of
+// the buffer must be reported, not silently capped down with no error.
+func TestDecoderDiscardShortBuffer(t *testing.T) {
+	d := newBytesDecoder([]byte("abc"))
+	d.remain = 10 // the decoder believes more data follows than the buffer holds
+
+	d.discard(5)
+	if d.err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", d.err)
+	}
+}
+
+func TestReadVarIntRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 127, -128, 1 << 20, -(1 << 20)} {
+		buf := new(bytes.Buffer)
+		e := newEncoder(buf)
+		e.writeVarInt(n)
+
+		d := newBytesDecoder(buf.Bytes())
+		if got := d.readVarInt(); got != n {
+			t.Fatalf("writeVarInt/readVarInt(%d): got %d", n, got)
+		}
+	}
+}
+
+func TestMinSizeOf(t *testing.T) {
+	tests := []struct {
+		typ  interface{}
+		want int
+	}{
+		{bool(false), 1},
+		{int8(0), 1},
+		{int16(0), 2},
+		{int32(0), 4},
+		{int64(0), 8},
+		{"", 1},
+	}
+	for _, tt := range tests {
+		got := minSizeOf(reflect.TypeOf(tt.typ))
+		if got != tt.want {
+			t.Errorf("minSizeOf(%T) = %d, want %d", tt.typ, got, tt.want)
+		}
+	}
+}
+
+// TestDecodeArrayWithTruncation drives decodeArrayWith directly: a huge
+// advertised element count against a small bounded remain must not
+// pre-allocate anywhere near that many elements, must stop as soon as the
+// input runs out, and must report ErrTruncatedArray instead of returning a
+// silently short slice.
+func TestDecodeArrayWithTruncation(t *testing.T) {
+	d := newBytesDecoder(bytes.Repeat([]byte{0, 0, 0, 7}, 2)) // two int32 elements, 8 bytes total
+	d.remain = 8
+
+	a := d.decodeArrayWith(math.MaxInt32, reflect.TypeOf(int32(0)), (*decoder).decodeInt32)
+
+	if d.err != ErrTruncatedArray {
+		t.Fatalf("expected ErrTruncatedArray, got %v", d.err)
+	}
+	if n := a.length(); n != 2 {
+		t.Fatalf("expected 2 elements to have been decoded before truncation, got %d", n)
+	}
+	if cap := a.value.Cap(); cap > 4 {
+		t.Fatalf("expected a capacity capped to what the bounded input could hold, got cap=%d", cap)
+	}
+}
+
+// TestDecodeArrayTruncation drives the full decodeArray path (the classic
+// int32-length-prefixed array used by decodeFuncOf on non-flexible struct
+// fields) with a malicious/corrupt length prefix, confirming the bound is
+// enforced end to end rather than just inside decodeArrayWith.
+func TestDecodeArrayTruncation(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf)
+	e.writeInt32(math.MaxInt32) // claims far more elements than follow
+	e.writeInt32(1)
+	e.writeInt32(2)
+
+	d := newBytesDecoder(buf.Bytes())
+
+	var out []int32
+	v := makeValue(reflect.ValueOf(&out).Elem())
+	d.decodeArray(v, reflect.TypeOf(int32(0)), (*decoder).decodeInt32)
+
+	if d.err != ErrTruncatedArray {
+		t.Fatalf("expected ErrTruncatedArray, got %v", d.err)
+	}
+	if len(out) != 2 || out[0] != 1 || out[1] != 2 {
+		t.Fatalf("got %v", out)
+	}
+}
+
+// TestDecodeCompactArrayTruncation is the KIP-482 compact-array counterpart
+// of TestDecodeArrayTruncation: the uvarint(n+1) length is the attacker's
+// lever here instead of a classic int32 length.
+func TestDecodeCompactArrayTruncation(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf)
+	e.writeUvarint(1 << 31) // n+1, claims ~2^31 elements
+	e.writeInt32(9)
+
+	d := newBytesDecoder(buf.Bytes())
+
+	var out []int32
+	v := makeValue(reflect.ValueOf(&out).Elem())
+	d.decodeCompactArray(v, reflect.TypeOf(int32(0)), (*decoder).decodeInt32)
+
+	if d.err != ErrTruncatedArray {
+		t.Fatalf("expected ErrTruncatedArray, got %v", d.err)
+	}
+	if len(out) != 1 || out[0] != 9 {
+		t.Fatalf("got %v", out)
+	}
+}
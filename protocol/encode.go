@@ -0,0 +1,315 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+)
+
+type encoder struct {
+	writer io.Writer
+	buffer [8]byte
+	err    error
+}
+
+func newEncoder(w io.Writer) *encoder {
+	return &encoder{writer: w}
+}
+
+func (e *encoder) Write(b []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.writer.Write(b)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}
+
+func (e *encoder) encodeBool(v value) {
+	e.writeBool(v.bool())
+}
+
+func (e *encoder) encodeInt8(v value) {
+	e.writeInt8(v.int8())
+}
+
+func (e *encoder) encodeInt16(v value) {
+	e.writeInt16(v.int16())
+}
+
+func (e *encoder) encodeInt32(v value) {
+	e.writeInt32(v.int32())
+}
+
+func (e *encoder) encodeInt64(v value) {
+	e.writeInt64(v.int64())
+}
+
+func (e *encoder) encodeString(v value) {
+	e.writeString(v.string())
+}
+
+func (e *encoder) encodeCompactString(v value) {
+	e.writeCompactString(v.string())
+}
+
+func (e *encoder) encodeBytes(v value) {
+	e.writeBytes(v.bytes())
+}
+
+func (e *encoder) encodeCompactBytes(v value) {
+	e.writeCompactBytes(v.bytes())
+}
+
+func (e *encoder) encodeUUID(v value) {
+	p := v.iface(reflect.PtrTo(uuidType)).(*[16]byte)
+	e.writeUUID(*p)
+}
+
+func (e *encoder) encodeArray(v value, elemType reflect.Type, encodeElem encodeFunc) {
+	a := v.array()
+	n := a.length()
+	if n < 0 {
+		e.writeInt32(-1)
+		return
+	}
+	e.writeInt32(int32(n))
+	for i := 0; i < n; i++ {
+		encodeElem(e, a.index(i))
+	}
+}
+
+// encodeCompactArray encodes a KIP-482 compact array: length is written as
+// uvarint(n+1), with 0 standing for a null array.
+func (e *encoder) encodeCompactArray(v value, elemType reflect.Type, encodeElem encodeFunc) {
+	a := v.array()
+	n := a.length()
+	if n < 0 {
+		e.writeUvarint(0)
+		return
+	}
+	e.writeUvarint(uint64(n + 1))
+	for i := 0; i < n; i++ {
+		encodeElem(e, a.index(i))
+	}
+}
+
+func (e *encoder) writeBool(b bool) {
+	if b {
+		e.writeInt8(1)
+	} else {
+		e.writeInt8(0)
+	}
+}
+
+func (e *encoder) writeInt8(i int8) {
+	e.buffer[0] = byte(i)
+	e.Write(e.buffer[:1])
+}
+
+func (e *encoder) writeInt16(i int16) {
+	putInt16(e.buffer[:2], i)
+	e.Write(e.buffer[:2])
+}
+
+func (e *encoder) writeInt32(i int32) {
+	putInt32(e.buffer[:4], i)
+	e.Write(e.buffer[:4])
+}
+
+func (e *encoder) writeInt64(i int64) {
+	putInt64(e.buffer[:8], i)
+	e.Write(e.buffer[:8])
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeInt16(int16(len(s)))
+	e.Write([]byte(s))
+}
+
+// writeCompactString writes the length as a signed varint followed by the
+// bytes, the form decoder.readCompactString reads back.
+func (e *encoder) writeCompactString(s string) {
+	e.writeVarInt(int64(len(s)))
+	e.Write([]byte(s))
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	if b == nil {
+		e.writeInt32(-1)
+		return
+	}
+	e.writeInt32(int32(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) writeCompactBytes(b []byte) {
+	if b == nil {
+		e.writeVarInt(-1)
+		return
+	}
+	e.writeVarInt(int64(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) writeUUID(u [16]byte) {
+	e.Write(u[:])
+}
+
+func (e *encoder) writeVarInt(i int64) {
+	u := uint64(i<<1) ^ uint64(i>>63)
+	e.writeUvarint(u)
+}
+
+// writeUvarint writes a plain base-128 unsigned varint, with no zigzag
+// step. It is the counterpart to decoder.readUvarint: KIP-482 compact-array
+// length prefixes and tagged-field headers are UNSIGNED_VARINT on the wire,
+// unlike the zigzag-encoded signed VarInt/VarLong written by writeVarInt
+// (which writeCompactString and writeCompactBytes use for their lengths).
+func (e *encoder) writeUvarint(u uint64) {
+	b := e.buffer[:0]
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+	b = append(b, byte(u))
+	e.Write(b)
+}
+
+// encodeTaggedFields writes the KIP-482 tagged-fields trailer of a flexible
+// struct: a uvarint count, then for each tagged field a (uvarint tag id,
+// uvarint size, payload) triple. Each field is encoded into a scratch buffer
+// first so its size can be written ahead of its bytes.
+func (e *encoder) encodeTaggedFields(v value, tagged []taggedEncodeFunc) {
+	e.writeUvarint(uint64(len(tagged)))
+	for _, f := range tagged {
+		e.writeUvarint(uint64(f.tagID))
+		buf := new(bytes.Buffer)
+		sub := newEncoder(buf)
+		f.encode(sub, v.fieldByIndex(f.index))
+		if sub.err != nil {
+			e.err = sub.err
+		}
+		e.writeUvarint(uint64(buf.Len()))
+		e.Write(buf.Bytes())
+	}
+}
+
+type taggedEncodeFunc struct {
+	encode encodeFunc
+	index  index
+	tagID  int
+}
+
+type encodeFunc func(*encoder, value)
+
+var (
+	writerTo = reflect.TypeOf((*io.WriterTo)(nil)).Elem()
+)
+
+func encodeFuncOf(typ reflect.Type, version int16, tag structTag) encodeFunc {
+	if reflect.PtrTo(typ).Implements(writerTo) {
+		return writerEncodeFuncOf(typ)
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return (*encoder).encodeBool
+	case reflect.Int8:
+		return (*encoder).encodeInt8
+	case reflect.Int16:
+		return (*encoder).encodeInt16
+	case reflect.Int32:
+		return (*encoder).encodeInt32
+	case reflect.Int64:
+		return (*encoder).encodeInt64
+	case reflect.String:
+		return stringEncodeFuncOf(tag)
+	case reflect.Struct:
+		return DefaultSchema.EncodeFuncOf(typ, version)
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 { // []byte
+			return bytesEncodeFuncOf(tag)
+		}
+		return arrayEncodeFuncOf(typ, version, tag)
+	case reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 && typ.Len() == 16 {
+			return (*encoder).encodeUUID
+		}
+		panic("unsupported array type: " + typ.String())
+	default:
+		panic("unsupported type: " + typ.String())
+	}
+}
+
+func stringEncodeFuncOf(tag structTag) encodeFunc {
+	if tag.Compact {
+		return (*encoder).encodeCompactString
+	}
+	return (*encoder).encodeString
+}
+
+func bytesEncodeFuncOf(tag structTag) encodeFunc {
+	if tag.Compact {
+		return (*encoder).encodeCompactBytes
+	}
+	return (*encoder).encodeBytes
+}
+
+func structEncodeFuncOf(typ reflect.Type, version int16) encodeFunc {
+	type field struct {
+		encode encodeFunc
+		index  index
+	}
+
+	var fields []field
+	var tagged []taggedEncodeFunc
+	var flexible bool
+
+	forEachStructField(typ, func(typ reflect.Type, index index, tag string) {
+		forEachStructTag(tag, func(tag structTag) bool {
+			if tag.MinVersion <= version && version <= tag.MaxVersion {
+				if tag.Compact {
+					flexible = true
+				}
+				encode := encodeFuncOf(typ, version, tag)
+				if tag.TagID >= 0 {
+					tagged = append(tagged, taggedEncodeFunc{encode: encode, index: index, tagID: tag.TagID})
+				} else {
+					fields = append(fields, field{encode: encode, index: index})
+				}
+				return false
+			}
+			return true
+		})
+	})
+
+	return func(e *encoder, v value) {
+		for i := range fields {
+			f := &fields[i]
+			f.encode(e, v.fieldByIndex(f.index))
+		}
+		if flexible {
+			e.encodeTaggedFields(v, tagged)
+		}
+	}
+}
+
+func arrayEncodeFuncOf(typ reflect.Type, version int16, tag structTag) encodeFunc {
+	elemType := typ.Elem()
+	elemFunc := encodeFuncOf(elemType, version, tag)
+	if tag.Compact {
+		return func(e *encoder, v value) { e.encodeCompactArray(v, elemType, elemFunc) }
+	}
+	return func(e *encoder, v value) { e.encodeArray(v, elemType, elemFunc) }
+}
+
+func writerEncodeFuncOf(typ reflect.Type) encodeFunc {
+	typ = reflect.PtrTo(typ)
+	return func(e *encoder, v value) {
+		if e.err == nil {
+			_, e.err = v.iface(typ).(io.WriterTo).WriteTo(e)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Direction distinguishes a request struct from a response struct when both
+// are registered under the same API key.
+type Direction int8
+
+const (
+	Request Direction = iota
+	Response
+)
+
+func (d Direction) String() string {
+	if d == Response {
+		return "response"
+	}
+	return "request"
+}
+
+// Schema is a registry of the request/response structs that back each Kafka
+// API key. structDecodeFuncOf/structEncodeFuncOf already walk a struct's
+// `kafka:"..."` tags to resolve per-field version ranges on every call;
+// decodeFuncOf/encodeFuncOf now route every struct through
+// DefaultSchema.DecodeFuncOf/EncodeFuncOf, which cache the compiled pair per
+// (type, version) so that walk only happens once. Schema also lets the
+// [min, max] version range implied by those same tags be asked about
+// directly via SupportedVersions, once the relevant types have Register'd.
+type Schema struct {
+	mutex   sync.Mutex
+	structs map[int16]map[Direction]reflect.Type
+	cache   sync.Map // cacheKey -> *schemaFuncs
+}
+
+// DefaultSchema is the registry that request/response types register
+// themselves with, typically from an init func next to the type
+// declaration.
+var DefaultSchema = new(Schema)
+
+// Register associates a Go struct type with a Kafka API key and direction.
+// It is the request/response type's own responsibility to call Register
+// (typically from an init func next to the type declaration, since only the
+// type itself knows its apiKey) — SupportedVersions and Dump only ever see
+// types that have done so.
+func (s *Schema) Register(apiKey int16, direction Direction, typ reflect.Type) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.structs == nil {
+		s.structs = make(map[int16]map[Direction]reflect.Type)
+	}
+	if s.structs[apiKey] == nil {
+		s.structs[apiKey] = make(map[Direction]reflect.Type)
+	}
+	s.structs[apiKey][direction] = typ
+}
+
+// SupportedVersions reports the [min, max] range of versions this client can
+// decode for apiKey, computed from the registered request and response
+// structs' MinVersion/MaxVersion tags. ok is false if nothing is registered
+// for apiKey. Intersecting the result with a broker's ApiVersions response
+// gives the versions that both sides support.
+func (s *Schema) SupportedVersions(apiKey int16) (min, max int16, ok bool) {
+	s.mutex.Lock()
+	types := make([]reflect.Type, 0, len(s.structs[apiKey]))
+	for _, typ := range s.structs[apiKey] {
+		types = append(types, typ)
+	}
+	s.mutex.Unlock()
+
+	for _, typ := range types {
+		tmin, tmax, tok := structVersionRange(typ)
+		if !tok {
+			continue
+		}
+		if !ok || tmin > min {
+			min = tmin
+		}
+		if !ok || tmax < max {
+			max = tmax
+		}
+		ok = true
+	}
+	return
+}
+
+// Dump returns a human-readable listing of every registered API key,
+// direction, and supported version range, one line per entry, sorted by API
+// key then direction. It exists to make debugging wire traffic against this
+// client easier.
+func (s *Schema) Dump() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	apiKeys := make([]int16, 0, len(s.structs))
+	for apiKey := range s.structs {
+		apiKeys = append(apiKeys, apiKey)
+	}
+	sort.Slice(apiKeys, func(i, j int) bool { return apiKeys[i] < apiKeys[j] })
+
+	var b strings.Builder
+	for _, apiKey := range apiKeys {
+		for _, direction := range [...]Direction{Request, Response} {
+			typ, ok := s.structs[apiKey][direction]
+			if !ok {
+				continue
+			}
+			min, max, _ := structVersionRange(typ)
+			fmt.Fprintf(&b, "apiKey=%d %s=%s versions=[v%d,v%d]\n", apiKey, direction, typ, min, max)
+		}
+	}
+	return b.String()
+}
+
+// structVersionRange scans every kafka struct tag on typ's fields and
+// returns the widest [min, max] version range they cover. ok is false if typ
+// has no kafka-tagged fields.
+func structVersionRange(typ reflect.Type) (min, max int16, ok bool) {
+	forEachStructField(typ, func(_ reflect.Type, _ index, tag string) {
+		forEachStructTag(tag, func(t structTag) bool {
+			if !ok || t.MinVersion < min {
+				min = t.MinVersion
+			}
+			if !ok || t.MaxVersion > max {
+				max = t.MaxVersion
+			}
+			ok = true
+			return true
+		})
+	})
+	return
+}
+
+type cacheKey struct {
+	typ     reflect.Type
+	version int16
+}
+
+type schemaFuncs struct {
+	decode decodeFunc
+	encode encodeFunc
+}
+
+// DecodeFuncOf returns the decodeFunc for typ at version, compiling and
+// caching it on first use.
+func (s *Schema) DecodeFuncOf(typ reflect.Type, version int16) decodeFunc {
+	return s.funcsFor(typ, version).decode
+}
+
+// EncodeFuncOf returns the encodeFunc for typ at version, compiling and
+// caching it on first use.
+func (s *Schema) EncodeFuncOf(typ reflect.Type, version int16) encodeFunc {
+	return s.funcsFor(typ, version).encode
+}
+
+func (s *Schema) funcsFor(typ reflect.Type, version int16) *schemaFuncs {
+	key := cacheKey{typ: typ, version: version}
+	if v, ok := s.cache.Load(key); ok {
+		return v.(*schemaFuncs)
+	}
+	f := &schemaFuncs{
+		decode: structDecodeFuncOf(typ, version),
+		encode: structEncodeFuncOf(typ, version),
+	}
+	actual, _ := s.cache.LoadOrStore(key, f)
+	return actual.(*schemaFuncs)
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaSupportedVersionsUnregistered(t *testing.T) {
+	s := new(Schema)
+	if _, _, ok := s.SupportedVersions(99); ok {
+		t.Fatalf("expected ok=false for an apiKey with nothing registered")
+	}
+}
+
+func TestSchemaRegisterAndDump(t *testing.T) {
+	type emptyRequest struct{}
+
+	s := new(Schema)
+	s.Register(42, Request, reflect.TypeOf(emptyRequest{}))
+
+	dump := s.Dump()
+	if !strings.Contains(dump, "apiKey=42") {
+		t.Fatalf("expected Dump to mention the registered apiKey, got %q", dump)
+	}
+	if !strings.Contains(dump, "request=") {
+		t.Fatalf("expected Dump to mention the direction, got %q", dump)
+	}
+}
+
+func TestSchemaFuncsForCachesByTypeAndVersion(t *testing.T) {
+	type emptyMessage struct{}
+
+	s := new(Schema)
+	typ := reflect.TypeOf(emptyMessage{})
+
+	f1 := s.funcsFor(typ, 3)
+	f2 := s.funcsFor(typ, 3)
+	if f1 != f2 {
+		t.Fatalf("expected the same (type, version) pair to return the cached *schemaFuncs")
+	}
+
+	f3 := s.funcsFor(typ, 4)
+	if f3 == f1 {
+		t.Fatalf("expected a different version to compile its own *schemaFuncs")
+	}
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import "reflect"
+
+// StructTag is the exported view of the version range and tag id that a
+// `kafka:"..."` struct tag carries, handed to Unmarshaler implementations so
+// they can make the same version/flexible-encoding decisions the
+// reflection-driven decoder already makes internally.
+type StructTag struct {
+	MinVersion int16
+	MaxVersion int16
+	Compact    bool
+	TagID      int
+}
+
+func (t structTag) exported() StructTag {
+	return StructTag{
+		MinVersion: t.MinVersion,
+		MaxVersion: t.MaxVersion,
+		Compact:    t.Compact,
+		TagID:      t.TagID,
+	}
+}
+
+// Reader is a narrowed, public wrapper around the internal decoder, passed
+// to Unmarshaler implementations. It exposes the primitive reads a
+// hand-written decoder needs while keeping the decoder's bounded-read
+// accounting (decoder.remain) and error handling private.
+type Reader struct {
+	d *decoder
+}
+
+func (r *Reader) ReadInt8() int8 {
+	return r.d.readInt8()
+}
+
+func (r *Reader) ReadInt16() int16 {
+	return r.d.readInt16()
+}
+
+func (r *Reader) ReadInt32() int32 {
+	return r.d.readInt32()
+}
+
+func (r *Reader) ReadInt64() int64 {
+	return r.d.readInt64()
+}
+
+func (r *Reader) ReadString() string {
+	return r.d.readString(false)
+}
+
+func (r *Reader) ReadCompactString() string {
+	return r.d.readCompactString(false)
+}
+
+func (r *Reader) ReadBytes() []byte {
+	return r.d.readBytes(false)
+}
+
+func (r *Reader) ReadCompactBytes() []byte {
+	return r.d.readCompactBytes(false)
+}
+
+// ReadStringBorrowed is like ReadString but avoids the copy: the returned
+// string aliases the decoder's input buffer. It is only valid until the next
+// read on this Reader (or the enclosing decode returns), so it must be used
+// by transient consumers only — e.g. hashed, parsed, or copied downstream
+// immediately — never stored past the call to UnmarshalKafka.
+func (r *Reader) ReadStringBorrowed() string {
+	return r.d.readString(true)
+}
+
+// ReadCompactStringBorrowed is the compact-encoding counterpart of
+// ReadStringBorrowed; the same lifetime restriction applies.
+func (r *Reader) ReadCompactStringBorrowed() string {
+	return r.d.readCompactString(true)
+}
+
+// ReadBytesBorrowed is like ReadBytes but avoids the copy: the returned
+// slice aliases the decoder's input buffer. It is only valid until the next
+// read on this Reader (or the enclosing decode returns), so it must be used
+// by transient consumers only — never retained past the call to
+// UnmarshalKafka.
+func (r *Reader) ReadBytesBorrowed() []byte {
+	return r.d.readBytes(true)
+}
+
+// ReadCompactBytesBorrowed is the compact-encoding counterpart of
+// ReadBytesBorrowed; the same lifetime restriction applies.
+func (r *Reader) ReadCompactBytesBorrowed() []byte {
+	return r.d.readCompactBytes(true)
+}
+
+func (r *Reader) ReadVarInt() int64 {
+	return r.d.readVarInt()
+}
+
+func (r *Reader) Discard(n int) {
+	r.d.discard(n)
+}
+
+// ReadArray reads a classic int32-length-prefixed array, invoking f once per
+// element with a Reader over the same underlying decoder. Decoding stops
+// early, surfacing ErrTruncatedArray through the enclosing decode, if the
+// input runs out before the advertised number of elements has been read.
+func (r *Reader) ReadArray(f func(*Reader) error) error {
+	n := r.d.readInt32()
+	for i := int32(0); i < n; i++ {
+		if r.d.remain <= 0 {
+			r.d.setError(ErrTruncatedArray)
+			break
+		}
+		if err := f(r); err != nil {
+			return err
+		}
+	}
+	return r.d.err
+}
+
+// Unmarshaler is implemented by types that know how to decode themselves
+// from the Kafka wire format. Unlike io.ReaderFrom, UnmarshalKafka also
+// receives the negotiated API version and the struct tag that selected it,
+// so record headers, compression codecs, and transactional markers can
+// choose a decode strategy without reimplementing primitive reads or losing
+// the decoder's bounded-read semantics.
+type Unmarshaler interface {
+	UnmarshalKafka(r *Reader, version int16, tag StructTag) error
+}
+
+var unmarshaler = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+func unmarshalerDecodeFuncOf(typ reflect.Type, version int16, tag structTag) decodeFunc {
+	typ = reflect.PtrTo(typ)
+	exported := tag.exported()
+	return func(d *decoder, v value) {
+		if d.err == nil {
+			d.err = v.iface(typ).(Unmarshaler).UnmarshalKafka(&Reader{d: d}, version, exported)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReaderPrimitives(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf)
+	e.writeInt8(1)
+	e.writeInt16(2)
+	e.writeInt32(3)
+	e.writeInt64(4)
+	e.writeString("hello")
+	e.writeBytes([]byte("world"))
+
+	r := &Reader{d: newBytesDecoder(buf.Bytes())}
+
+	if v := r.ReadInt8(); v != 1 {
+		t.Fatalf("ReadInt8: got %d", v)
+	}
+	if v := r.ReadInt16(); v != 2 {
+		t.Fatalf("ReadInt16: got %d", v)
+	}
+	if v := r.ReadInt32(); v != 3 {
+		t.Fatalf("ReadInt32: got %d", v)
+	}
+	if v := r.ReadInt64(); v != 4 {
+		t.Fatalf("ReadInt64: got %d", v)
+	}
+	if v := r.ReadString(); v != "hello" {
+		t.Fatalf("ReadString: got %q", v)
+	}
+	if v := r.ReadBytes(); string(v) != "world" {
+		t.Fatalf("ReadBytes: got %q", v)
+	}
+}
+
+func TestReaderBorrowedReadsAliasInput(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf)
+	e.writeBytes([]byte("borrowed"))
+
+	input := buf.Bytes()
+	r := &Reader{d: newBytesDecoder(input)}
+
+	b := r.ReadBytesBorrowed()
+	if string(b) != "borrowed" {
+		t.Fatalf("got %q", b)
+	}
+
+	// A borrowed read must alias the original input, unlike ReadBytes which
+	// copies; mutating the decoded slice mutates the source.
+	b[0] = 'B'
+	if !bytes.Contains(input, []byte("Borrowed")) {
+		t.Fatalf("ReadBytesBorrowed copied instead of aliasing the input")
+	}
+}
+
+func TestReaderReadArray(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf)
+	e.writeInt32(3) // array length
+	e.writeInt32(10)
+	e.writeInt32(20)
+	e.writeInt32(30)
+
+	r := &Reader{d: newBytesDecoder(buf.Bytes())}
+
+	var got []int32
+	err := r.ReadArray(func(r *Reader) error {
+		got = append(got, r.ReadInt32())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 3 || got[0] != 10 || got[1] != 20 || got[2] != 30 {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestReaderReadArrayTruncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf)
+	e.writeInt32(1000) // claims far more elements than the input holds
+	e.writeInt32(1)
+
+	r := &Reader{d: newBytesDecoder(buf.Bytes())}
+
+	var n int
+	r.ReadArray(func(r *Reader) error {
+		r.ReadInt32()
+		n++
+		return nil
+	})
+
+	if r.d.err != ErrTruncatedArray {
+		t.Fatalf("expected ErrTruncatedArray, got %v", r.d.err)
+	}
+	if n >= 1000 {
+		t.Fatalf("ReadArray kept going past the bounded input: read %d elements", n)
+	}
+}
+
+// fakeRecord is a stand-in for a hand-written type (e.g. a record header or
+// compression codec) that implements Unmarshaler directly instead of going
+// through reflection-driven struct decoding.
+type fakeRecord struct {
+	version int16
+	tag     StructTag
+	value   int32
+}
+
+func (f *fakeRecord) UnmarshalKafka(r *Reader, version int16, tag StructTag) error {
+	f.version = version
+	f.tag = tag
+	f.value = r.ReadInt32()
+	return nil
+}
+
+func TestUnmarshalerDirect(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := newEncoder(buf)
+	e.writeInt32(42)
+
+	var rec fakeRecord
+	r := &Reader{d: newBytesDecoder(buf.Bytes())}
+	tag := StructTag{MinVersion: 0, MaxVersion: 9, TagID: -1}
+
+	if err := rec.UnmarshalKafka(r, 7, tag); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.value != 42 || rec.version != 7 || rec.tag != tag {
+		t.Fatalf("got %+v", rec)
+	}
+}
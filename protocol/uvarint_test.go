@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestWriteUvarintIsNotZigzag pins down the exact wire byte for a small tag
+// id: KIP-482 tag ids and compact-array length prefixes are UNSIGNED_VARINT, so 5
+// must be written as 0x05. writeVarInt (signed, zigzag) would instead write
+// 0x0A, which desyncs any real broker or client decoding this wire format.
+func TestWriteUvarintIsNotZigzag(t *testing.T) {
+	buf := new(bytes.Buffer)
+	newEncoder(buf).writeUvarint(5)
+	if got := buf.Bytes(); len(got) != 1 || got[0] != 0x05 {
+		t.Fatalf("writeUvarint(5) = %#v, want [0x05]", got)
+	}
+}
+
+func TestReadWriteUvarintRoundTrip(t *testing.T) {
+	for _, n := range []uint64{0, 1, 5, 127, 128, 300, 1 << 20, 1 << 33} {
+		buf := new(bytes.Buffer)
+		newEncoder(buf).writeUvarint(n)
+
+		d := newBytesDecoder(buf.Bytes())
+		if got := d.readUvarint(); got != n {
+			t.Fatalf("writeUvarint/readUvarint(%d): got %d", n, got)
+		}
+	}
+}